@@ -48,8 +48,9 @@ from google.rpc.status_pb2 import Status
 from google.rpc import code_pb2
 from google.type.latlng_pb2 import LatLng
 
-__version__ = '7.0.1'
-VERSION = (7, 0, 1, '~')
+# setup.py and the Makefile read the version from here.
+__version__ = '7.0.2'
+VERSION = (7, 0, 2, '~')
 
 _conn_holder = {}  # thread id -> thread-local connection.
 _options = {}  # Global options.
@@ -70,6 +71,11 @@ def set_options(**kwargs):
         is also set.
     host: the Cloud Datastore API host to use. Defaults to the Google APIs
         production server. Must not be set if project_endpoint is also set.
+    quota_project_id: the Cloud project to bill for quota and usage.
+        Defaults to the project of the credentials.
+    user_agent: an application identifier appended to the User-Agent header.
+    slow_call_threshold: if set, calls taking at least this many seconds,
+        including failed ones, are logged as warnings.
   """
   with(_rlock):
     _options.update(kwargs)
@@ -100,31 +106,41 @@ def get_default_connection():
   return conn
 
 
-def lookup(request):
+def lookup(request, **kwargs):
   """See connection.Datastore.lookup."""
-  return get_default_connection().lookup(request)
+  return get_default_connection().lookup(request, **kwargs)
 
 
-def run_query(request):
+def lookup_all(request, **kwargs):
+  """See connection.Datastore.lookup_all."""
+  return get_default_connection().lookup_all(request, **kwargs)
+
+
+def run_query(request, **kwargs):
   """See connection.Datastore.run_query."""
-  return get_default_connection().run_query(request)
+  return get_default_connection().run_query(request, **kwargs)
+
+
+def run_query_all(request, **kwargs):
+  """See connection.Datastore.run_query_all."""
+  return get_default_connection().run_query_all(request, **kwargs)
 
 
-def begin_transaction(request):
+def begin_transaction(request, **kwargs):
   """See connection.Datastore.begin_transaction."""
-  return get_default_connection().begin_transaction(request)
+  return get_default_connection().begin_transaction(request, **kwargs)
 
 
-def commit(request):
+def commit(request, **kwargs):
   """See connection.Datastore.commit."""
-  return get_default_connection().commit(request)
+  return get_default_connection().commit(request, **kwargs)
 
 
-def rollback(request):
+def rollback(request, **kwargs):
   """See connection.Datastore.rollback."""
-  return get_default_connection().rollback(request)
+  return get_default_connection().rollback(request, **kwargs)
 
 
-def allocate_ids(request):
+def allocate_ids(request, **kwargs):
   """See connection.Datastore.allocate_ids."""
-  return get_default_connection().allocate_ids(request)
+  return get_default_connection().allocate_ids(request, **kwargs)
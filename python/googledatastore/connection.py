@@ -15,13 +15,19 @@
 #
 """googledatastore connection."""
 
+import email.utils
 import logging
+import platform
+import time
 import httplib2
 
 from googledatastore import helper
 from google.cloud.proto.datastore.v1 import datastore_pb2
+from google.cloud.proto.datastore.v1 import query_pb2
+from google.protobuf.message import DecodeError
 from google.protobuf import timestamp_pb2
 from google.rpc import code_pb2
+from google.rpc import error_details_pb2
 from google.rpc import status_pb2
 from google.type import latlng_pb2
 
@@ -29,36 +35,69 @@ __all__ = [
     'Datastore',
     'Error',
     'RPCError',
+    'is_retryable',
+    'is_aborted',
+    'is_not_found',
+    'is_already_exists',
 ]
 
+# Error codes for which the Datastore documentation recommends a retry with
+# exponential backoff.
+_RETRYABLE_CODES = frozenset([
+    code_pb2.ABORTED,
+    code_pb2.DEADLINE_EXCEEDED,
+    code_pb2.INTERNAL,
+    code_pb2.RESOURCE_EXHAUSTED,
+    code_pb2.UNAVAILABLE,
+])
+
+# Maximum size of an entity, in bytes.
+MAX_ENTITY_SIZE = 1048572
+# Maximum size of an API request, in bytes.
+MAX_REQUEST_SIZE = 10 * 1024 * 1024
+
 
 class Datastore(object):
   """Datastore client connection constructor."""
 
   def __init__(self, project_id=None, credentials=None, project_endpoint=None,
-               host=None):
+               host=None, quota_project_id=None, user_agent=None,
+               slow_call_threshold=None):
     """Datastore client connection constructor.
 
     Args:
-      project_id: the Cloud project to use. Exactly one of
-          project_endpoint and project_id must be set.
+      project_id: the Cloud project to use. At most one of project_endpoint
+          and project_id may be set. If neither is, the project is discovered
+          with helper.get_project_id_from_env().
       credentials: oauth2client.Credentials to authorize the
           connection, default to no credentials.
-      project_endpoint: the Cloud Datastore API project endpoint to use. Exactly one of
-          project_endpoint and project_id must be set. Must not be set if
-          host is also set.
+      project_endpoint: the Cloud Datastore API project endpoint to use. At most
+          one of project_endpoint and project_id may be set. Must not be set
+          if host is also set.
       host: the Cloud Datastore API host to use. Must not be set if project_endpoint
          is also set.
+      quota_project_id: the Cloud project to bill for quota and usage, sent
+         as the x-goog-user-project header. Defaults to the project of the
+         credentials.
+      user_agent: an application identifier appended to the User-Agent
+         header, for example 'my-app/1.2'.
+      slow_call_threshold: if set, calls taking at least this many seconds,
+         including failed ones, are logged as warnings with a summary of the
+         request.
 
     Usage: demos/trivial.py for example usages.
 
     Raises:
-      TypeError: when neither or both of project_endpoint and project_id
-      are set or when both project_endpoint and host are set.
+      TypeError: when both project_endpoint and project_id are set or when
+      both project_endpoint and host are set.
+      ValueError: when neither project_endpoint nor project_id is set and no
+      project could be discovered from the environment.
     """
     self._http = httplib2.Http()
-    if not project_endpoint and not project_id:
-      raise TypeError('project_endpoint or project_id argument is required.')
+    self._slow_call_threshold = slow_call_threshold
+    self._headers = _make_client_headers(user_agent)
+    if quota_project_id:
+      self._headers['x-goog-user-project'] = quota_project_id
     if project_endpoint and project_id:
       raise TypeError('only one of project_endpoint and project_id argument '
                       'is allowed.')
@@ -75,11 +114,13 @@ class Datastore(object):
     else:
       logging.warning('no datastore credentials')
 
-  def lookup(self, request):
+  def lookup(self, request, headers=None):
     """Lookup entities by key.
 
     Args:
       request: LookupRequest proto message.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
     Returns:
       LookupResponse proto message.
@@ -89,13 +130,44 @@ class Datastore(object):
           (See: .response attribute)
     """
     return self._call_method('lookup', request,
-                             datastore_pb2.LookupResponse)
+                             datastore_pb2.LookupResponse,
+                             headers)
+
+  def lookup_all(self, request, headers=None):
+    """Lookup entities by key, re-issuing lookups for deferred keys.
+
+    Args:
+      request: LookupRequest proto message. It is not modified.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
-  def run_query(self, request):
+    Returns:
+      LookupResponse proto message with the found and missing results of
+      every lookup. deferred is always empty.
+
+    Raises:
+      RPCError: The underlying RPC call failed with an HTTP error.
+          (See: .response attribute)
+    """
+    req = datastore_pb2.LookupRequest()
+    req.CopyFrom(request)
+    result = datastore_pb2.LookupResponse()
+    while True:
+      resp = self.lookup(req, headers)
+      result.found.extend(resp.found)
+      result.missing.extend(resp.missing)
+      if not resp.deferred:
+        return result
+      del req.keys[:]
+      req.keys.extend(resp.deferred)
+
+  def run_query(self, request, headers=None):
     """Query for entities.
 
     Args:
       request: RunQueryRequest proto message.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
     Returns:
       RunQueryResponse proto message.
@@ -105,13 +177,54 @@ class Datastore(object):
           (See: .response attribute)
     """
     return self._call_method('runQuery', request,
-                             datastore_pb2.RunQueryResponse)
+                             datastore_pb2.RunQueryResponse,
+                             headers)
+
+  def run_query_all(self, request, headers=None):
+    """Query for entities, fetching every batch.
+
+    Calls run_query repeatedly, continuing from the end cursor of each batch
+    for as long as the batch reports NOT_FINISHED. The query offset and limit
+    are reduced by the results already skipped and returned. GQL queries are
+    continued using the parsed query returned with the first batch.
+
+    Args:
+      request: RunQueryRequest proto message. It is not modified.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
-  def begin_transaction(self, request):
+    Yields:
+      EntityResult proto messages.
+
+    Raises:
+      RPCError: The underlying RPC call failed with an HTTP error.
+          (See: .response attribute)
+    """
+    req = datastore_pb2.RunQueryRequest()
+    req.CopyFrom(request)
+    while True:
+      resp = self.run_query(req, headers)
+      batch = resp.batch
+      for result in batch.entity_results:
+        yield result
+      if batch.more_results != query_pb2.QueryResultBatch.NOT_FINISHED:
+        return
+      if req.HasField('gql_query'):
+        req.query.CopyFrom(resp.query)
+      query = req.query
+      query.start_cursor = batch.end_cursor
+      query.offset = max(0, query.offset - batch.skipped_results)
+      if query.HasField('limit'):
+        query.limit.value = max(
+            0, query.limit.value - len(batch.entity_results))
+
+  def begin_transaction(self, request, headers=None):
     """Begin a new transaction.
 
     Args:
       request: BeginTransactionRequest proto message.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
     Returns:
       BeginTransactionResponse proto message.
@@ -121,29 +234,38 @@ class Datastore(object):
           (See: .response attribute)
     """
     return self._call_method('beginTransaction', request,
-                             datastore_pb2.BeginTransactionResponse)
+                             datastore_pb2.BeginTransactionResponse,
+                             headers)
 
-  def commit(self, request):
+  def commit(self, request, headers=None):
     """Commit a mutation, transaction or mutation in a transaction.
 
     Args:
       request: CommitRequest proto message.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
     Returns:
       CommitResponse proto message.
 
     Raises:
+      ValueError: An entity exceeds MAX_ENTITY_SIZE or the request exceeds
+          MAX_REQUEST_SIZE.
       RPCError: The underlying RPC call failed with an HTTP error.
           (See: .response attribute)
     """
+    _check_commit_size(request)
     return self._call_method('commit', request,
-                             datastore_pb2.CommitResponse)
+                             datastore_pb2.CommitResponse,
+                             headers)
 
-  def rollback(self, request):
+  def rollback(self, request, headers=None):
     """Rollback a transaction.
 
     Args:
       request: RollbackRequest proto message.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
     Returns:
       RollbackResponse proto message.
@@ -153,13 +275,16 @@ class Datastore(object):
           (See: .response attribute)
     """
     return self._call_method('rollback', request,
-                             datastore_pb2.RollbackResponse)
+                             datastore_pb2.RollbackResponse,
+                             headers)
 
-  def allocate_ids(self, request):
+  def allocate_ids(self, request, headers=None):
     """Allocate ids for incomplete keys.
 
     Args:
       request: AllocateIdsRequest proto message.
+      headers: optional dict of additional HTTP headers to send with the
+          request, for example x-goog-request-params.
 
     Returns:
       AllocateIdsResponse proto message.
@@ -169,9 +294,10 @@ class Datastore(object):
           (See: .response attribute)
     """
     return self._call_method('allocateIds', request,
-                             datastore_pb2.AllocateIdsResponse)
+                             datastore_pb2.AllocateIdsResponse,
+                             headers)
 
-  def _call_method(self, method, req, resp_class):
+  def _call_method(self, method, req, resp_class, extra_headers=None):
     """_call_method call the given RPC method over HTTP.
 
     It uses the given protobuf message request as the payload and
@@ -181,6 +307,9 @@ class Datastore(object):
       method: RPC method name to be called.
       req: protobuf message for the RPC request.
       resp_class: protobuf message class for the RPC response.
+      extra_headers: optional dict of additional HTTP headers. They take
+          precedence over the connection headers but cannot override the
+          headers required by the protocol.
 
     Returns:
       Deserialized resp_class protobuf message instance.
@@ -189,28 +318,149 @@ class Datastore(object):
       RPCError: The rpc method call failed.
     """
     payload = req.SerializeToString()
-    headers = {
+    protocol_headers = {
         'Content-Type': 'application/x-protobuf',
         'Content-Length': str(len(payload)),
         'X-Goog-Api-Format-Version': '2'
         }
-    response, content = self._http.request(
-        '%s:%s' % (self._url, method),
-        method='POST', body=payload, headers=headers)
-    if response.status != 200:
-      raise _make_rpc_error(method, response, content)
-    resp = resp_class()
-    resp.ParseFromString(content)
-    return resp
+    # Header names are case-insensitive, so merge on the lowercase name and
+    # keep the spelling of the header that wins.
+    merged = {}
+    for name, value in (self._headers.items()
+                        + (extra_headers or {}).items()
+                        + protocol_headers.items()):
+      merged[name.lower()] = (name, value)
+    headers = dict(merged.values())
+    start = time.time()
+    resp = None
+    try:
+      response, content = self._http.request(
+          '%s:%s' % (self._url, method),
+          method='POST', body=payload, headers=headers)
+      if response.status != 200:
+        raise _make_rpc_error(method, response, content)
+      resp = resp_class()
+      resp.ParseFromString(content)
+      return resp
+    finally:
+      # Failed calls are logged too, since deadlines are the usual hotspot.
+      elapsed = time.time() - start
+      if (self._slow_call_threshold is not None
+          and elapsed >= self._slow_call_threshold):
+        logging.warning('slow datastore call %s took %.3fs: %s',
+                        method, elapsed, _describe_call(req, resp))
+
+
+def _describe_call(req, resp):
+  """Returns a short summary of an RPC for logging, without any values.
+
+  Args:
+    req: protobuf message for the RPC request.
+    resp: protobuf message for the RPC response, or None if the call failed.
+  """
+  if isinstance(req, datastore_pb2.RunQueryRequest):
+    if req.HasField('gql_query'):
+      # The query string may contain literals, so only describe its bindings.
+      shape = 'gql bindings=%d' % (len(req.gql_query.named_bindings)
+                                   + len(req.gql_query.positional_bindings))
+    else:
+      shape = 'kind=%s filter=%s order=%s' % (
+          ','.join(k.name for k in req.query.kind),
+          _describe_filter(req.query.filter) or '-',
+          ','.join(o.property.name for o in req.query.order) or '-')
+    if resp is None:
+      description = shape
+    else:
+      description = '%s batch_size=%d' % (shape,
+                                          len(resp.batch.entity_results))
+  elif isinstance(req, datastore_pb2.CommitRequest):
+    description = 'mutations=%d' % len(req.mutations)
+  elif isinstance(req, datastore_pb2.LookupRequest):
+    description = 'keys=%d' % len(req.keys)
+  else:
+    description = '%d bytes' % req.ByteSize()
+  if resp is None:
+    description += ' (failed)'
+  return description
+
+
+def _describe_filter(filter_proto):
+  """Returns the filtered property names of a datastore.Filter, not values."""
+  filter_type = filter_proto.WhichOneof('filter_type')
+  if filter_type == 'property_filter':
+    return filter_proto.property_filter.property.name
+  if filter_type == 'composite_filter':
+    return '(%s)' % ','.join(_describe_filter(f)
+                             for f in filter_proto.composite_filter.filters)
+  return ''
+
+
+def _make_client_headers(user_agent=None):
+  """Returns the headers identifying this client library and its version."""
+  # Imported here since the package imports this module.
+  from googledatastore import __version__
+  agent = 'googledatastore-python/%s' % __version__
+  if user_agent:
+    agent = '%s %s' % (agent, user_agent)
+  return {
+      'User-Agent': agent,
+      'x-goog-api-client': 'gl-python/%s googledatastore/%s' % (
+          platform.python_version(), __version__),
+  }
+
+
+def _check_commit_size(request):
+  """Checks a CommitRequest against the Datastore size limits.
+
+  The server computes entity sizes slightly differently, so this only catches
+  requests that are certain to be rejected.
+
+  Args:
+    request: CommitRequest proto message.
+
+  Raises:
+    ValueError: An entity exceeds MAX_ENTITY_SIZE or the request exceeds
+        MAX_REQUEST_SIZE.
+  """
+  for mutation in request.mutations:
+    operation = mutation.WhichOneof('operation')
+    if operation not in ('insert', 'update', 'upsert'):
+      continue
+    entity = getattr(mutation, operation)
+    size = entity.ByteSize()
+    if size > MAX_ENTITY_SIZE:
+      raise ValueError('entity %s is %d bytes, which exceeds the maximum '
+                       'entity size of %d bytes.'
+                       % (_format_key(entity.key), size, MAX_ENTITY_SIZE))
+  size = request.ByteSize()
+  if size > MAX_REQUEST_SIZE:
+    raise ValueError('commit request is %d bytes, which exceeds the maximum '
+                     'request size of %d bytes.' % (size, MAX_REQUEST_SIZE))
+
+
+def _format_key(key):
+  """Formats a datastore.Key as a readable path for error messages."""
+  elems = []
+  for elem in key.path:
+    id_type = elem.WhichOneof('id_type')
+    if id_type == 'id':
+      elems.append('%s(%d)' % (elem.kind, elem.id))
+    elif id_type == 'name':
+      elems.append('%s(%r)' % (elem.kind, elem.name))
+    else:
+      elems.append('%s()' % elem.kind)
+  return '/'.join(elems)
 
 
 def _make_rpc_error(method, response, content):
+  retry_after = _parse_retry_after(response)
   if ('content-type' not in response
       or response['content-type'] != 'application/x-protobuf'):
     return RPCError(
-        method, code_pb2.INTERNAL,
+        method, _code_from_http_status(response.status),
         ('Non-protobuf error: %s. HTTP status code was: %s'
-         % (content, response.status)))
+         % (content, response.status)),
+        retry_after=retry_after)
 
   try:
     status = status_pb2.Status()
@@ -218,18 +468,96 @@ def _make_rpc_error(method, response, content):
     if status.code == code_pb2.OK:
       # We may have accidentally successfully parsed a non-Status message.
       return RPCError(
-        method, code_pb2.INTERNAL,
+        method, _code_from_http_status(response.status),
         ('Unexpected OK error code with HTTP status code of %d. Message: %s'
-         % (response.status, status.message)))
+         % (response.status, status.message)),
+        retry_after=retry_after)
+    details = [_unpack_error_detail(any_pb) for any_pb in status.details]
+    if retry_after is None:
+      for detail in details:
+        if isinstance(detail, error_details_pb2.RetryInfo):
+          retry_after = (detail.retry_delay.seconds
+                         + detail.retry_delay.nanos / 1e9)
     return RPCError(
         method, status.code,
         ('Error code: %s. Message: %s'
-         % (code_pb2.Code.Name(status.code), status.message)))
+         % (code_pb2.Code.Name(status.code), status.message)),
+        retry_after=retry_after, details=details)
   except Exception:
     return RPCError(
-        method, code_pb2.INTERNAL,
+        method, _code_from_http_status(response.status),
         ('Unable to parse Status protocol buffer: HTTP status code was %s.'
-         % response.status))
+         % response.status),
+        retry_after=retry_after)
+
+
+# HTTP status -> google.rpc code, for errors without a parsable Status.
+_HTTP_STATUS_CODES = {
+    400: code_pb2.INVALID_ARGUMENT,
+    401: code_pb2.UNAUTHENTICATED,
+    403: code_pb2.PERMISSION_DENIED,
+    404: code_pb2.NOT_FOUND,
+    409: code_pb2.ABORTED,
+    429: code_pb2.RESOURCE_EXHAUSTED,
+    503: code_pb2.UNAVAILABLE,
+    504: code_pb2.DEADLINE_EXCEEDED,
+}
+
+
+def _code_from_http_status(status):
+  """Returns the google.rpc code that best matches an HTTP status.
+
+  Statuses without a closer match map to UNKNOWN, except 5xx responses,
+  which map to INTERNAL.
+  """
+  code = _HTTP_STATUS_CODES.get(status)
+  if code is not None:
+    return code
+  if 500 <= status < 600:
+    return code_pb2.INTERNAL
+  return code_pb2.UNKNOWN
+
+
+def _unpack_error_detail(any_pb):
+  """Unpacks a google.rpc error detail, returning any_pb if it is unknown."""
+  detail_class = _ERROR_DETAIL_CLASSES.get(any_pb.TypeName())
+  if detail_class is None:
+    return any_pb
+  detail = detail_class()
+  try:
+    if not any_pb.Unpack(detail):
+      return any_pb
+  except DecodeError:
+    # Keep the status code usable even if a detail is malformed.
+    return any_pb
+  return detail
+
+
+# Full proto name -> message class for the google.rpc error detail types.
+_ERROR_DETAIL_CLASSES = dict(
+    (descriptor.full_name, getattr(error_details_pb2, name))
+    for name, descriptor
+    in error_details_pb2.DESCRIPTOR.message_types_by_name.items())
+
+
+def _parse_retry_after(response):
+  """Returns the delay in seconds suggested by a Retry-After header, or None.
+
+  Args:
+    response: httplib2.Response. The header value is either a number of
+        seconds or an HTTP date.
+  """
+  value = response.get('retry-after')
+  if not value:
+    return None
+  try:
+    return max(0.0, float(value))
+  except ValueError:
+    pass
+  date = email.utils.parsedate_tz(value)
+  if date is None:
+    return None
+  return max(0.0, email.utils.mktime_tz(date) - time.time())
 
 
 class Error(Exception):
@@ -243,14 +571,63 @@ class RPCError(Error):
   method = None
   code = None
   message = None
+  # Seconds the server asked the client to wait before retrying, or None.
+  retry_after = None
+  # Error details from the google.rpc.Status. Known types are unpacked into
+  # google.rpc.error_details_pb2 messages, others are left as Any messages.
+  details = ()
 
   _failure_format = ('datastore call {method} failed: {message}')
 
-  def __init__(self, method, code, message):
+  def __init__(self, method, code, message, retry_after=None, details=()):
     self.method = method
     self.code = code
     self.message = message
+    self.retry_after = retry_after
+    self.details = list(details)
     super(RPCError, self).__init__(method, code, message)
 
+  def get_detail(self, detail_class):
+    """Returns the first error detail of the given class, or None.
+
+    Usage:
+      >>> info = e.get_detail(error_details_pb2.ErrorInfo)
+      >>> if info and info.reason == 'RATE_LIMIT_EXCEEDED': ...
+    """
+    for detail in self.details:
+      if isinstance(detail, detail_class):
+        return detail
+    return None
+
   def __str__(self):
     return self._failure_format.format(method=self.method, message=self.message)
+
+
+def is_retryable(error):
+  """Returns True if error is an RPCError that is worth retrying.
+
+  Callers should retry with exponential backoff, honoring error.retry_after
+  when it is set. Non-transactional commits are only safe to retry if their
+  mutations are idempotent.
+  """
+  return isinstance(error, RPCError) and error.code in _RETRYABLE_CODES
+
+
+def is_aborted(error):
+  """Returns True if error is an RPCError for a transaction contention abort."""
+  return isinstance(error, RPCError) and error.code == code_pb2.ABORTED
+
+
+def is_not_found(error):
+  """Returns True if error is an RPCError with a NOT_FOUND code."""
+  return isinstance(error, RPCError) and error.code == code_pb2.NOT_FOUND
+
+
+def is_already_exists(error):
+  """Returns True if error is an RPCError with an ALREADY_EXISTS code.
+
+  Commits fail with this code when an insert mutation targets an existing
+  entity.
+  """
+  return (isinstance(error, RPCError)
+          and error.code == code_pb2.ALREADY_EXISTS)
@@ -18,6 +18,7 @@
 __author__ = 'proppy@google.com (Johan Euphrosine)'
 
 import os
+import platform
 import threading
 import unittest
 
@@ -27,7 +28,9 @@ import mox
 import googledatastore as datastore
 from googledatastore import connection
 from googledatastore import helper
+from google.protobuf import timestamp_pb2
 from google.rpc import code_pb2
+from google.rpc import error_details_pb2
 
 
 class FakeCredentialsFromEnv(object):
@@ -72,6 +75,9 @@ class DatastoreTest(unittest.TestCase):
         'Content-Type': 'application/x-protobuf',
         'Content-Length': str(len(payload)),
         'X-Goog-Api-Format-Version': '2',
+        'User-Agent': 'googledatastore-python/%s' % datastore.__version__,
+        'x-goog-api-client': 'gl-python/%s googledatastore/%s' % (
+            platform.python_version(), datastore.__version__),
     }
 
   def expectRequest(self, *args, **kwargs):
@@ -79,8 +85,23 @@ class DatastoreTest(unittest.TestCase):
     return self.conn._http.request(*args, **kwargs)
 
   def testProjectIdRequired(self):
-    self.assertRaises(TypeError, datastore.Datastore, None)
+    self.mox.StubOutWithMock(helper, 'get_project_endpoint_from_env')
+    helper.get_project_endpoint_from_env(project_id=None, host=None).AndRaise(
+        ValueError('project_id was not provided.'))
+    self.mox.ReplayAll()
+    self.assertRaises(ValueError, datastore.Datastore, None)
     self.assertRaises(TypeError, datastore.Datastore, None, port=8080)
+    self.mox.VerifyAll()
+
+  def testProjectIdDiscovered(self):
+    self.mox.StubOutWithMock(helper, 'get_project_endpoint_from_env')
+    helper.get_project_endpoint_from_env(
+        project_id=None, host='a.b.c').AndReturn(
+            'https://a.b.c/v1/projects/bar')
+    self.mox.ReplayAll()
+    conn = datastore.Datastore(host='a.b.c')
+    self.assertEqual('https://a.b.c/v1/projects/bar', conn._url)
+    self.mox.VerifyAll()
 
   def testLookupSuccess(self):
     request = self.makeLookupRequest()
@@ -103,6 +124,72 @@ class DatastoreTest(unittest.TestCase):
     self.assertEqual(proto_response, resp)
     self.mox.VerifyAll()
 
+  def testLookupAll(self):
+    request = datastore.LookupRequest()
+    for name in ('a', 'b', 'c'):
+      request.keys.add().path.add().name = name
+    first_response = datastore.LookupResponse()
+    first_response.found.add().entity.key.CopyFrom(request.keys[0])
+    first_response.deferred.add().CopyFrom(request.keys[1])
+    first_response.deferred.add().CopyFrom(request.keys[2])
+    second_request = datastore.LookupRequest()
+    second_request.keys.extend(first_response.deferred)
+    second_response = datastore.LookupResponse()
+    second_response.found.add().entity.key.CopyFrom(request.keys[1])
+    second_response.missing.add().entity.key.CopyFrom(request.keys[2])
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+
+    self.mox.StubOutWithMock(self.conn._http, 'request')
+    for req, resp in ((request, first_response),
+                      (second_request, second_response)):
+      payload = req.SerializeToString()
+      self.conn._http.request(
+          'https://example.com/datastore/v1/projects/foo:lookup',
+          method='POST', body=payload,
+          headers=self.makeExpectedHeaders(payload)).AndReturn((
+              response,
+              resp.SerializeToString()))
+    self.mox.ReplayAll()
+
+    resp = self.conn.lookup_all(request)
+    self.assertEqual(['a', 'b'],
+                     [r.entity.key.path[0].name for r in resp.found])
+    self.assertEqual(['c'],
+                     [r.entity.key.path[0].name for r in resp.missing])
+    self.assertEqual(0, len(resp.deferred))
+    self.assertEqual(3, len(request.keys))
+    self.mox.VerifyAll()
+
+  def testLookupWithHeaders(self):
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    proto_response = self.makeLookupResponse()
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+    expected_headers = self.makeExpectedHeaders(payload)
+    expected_headers['x-goog-request-params'] = 'project_id=foo'
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST', body=payload,
+        headers=expected_headers).AndReturn((
+            response,
+            proto_response.SerializeToString()))
+    self.mox.ReplayAll()
+
+    resp = self.conn.lookup(request, headers={
+        'x-goog-request-params': 'project_id=foo',
+        # Protocol headers cannot be overridden.
+        'content-type': 'text/plain',
+    })
+    self.assertEqual(proto_response, resp)
+    self.mox.VerifyAll()
+
   def testLookupFailure(self):
     request = self.makeLookupRequest()
     payload = request.SerializeToString()
@@ -130,6 +217,77 @@ class DatastoreTest(unittest.TestCase):
       self.conn.lookup(request)
     self.mox.VerifyAll()
 
+  def testLookupFailureWithDetails(self):
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    status = datastore.Status()
+    status.code = code_pb2.INVALID_ARGUMENT
+    status.message = 'An error message.'
+    bad_request = error_details_pb2.BadRequest()
+    violation = bad_request.field_violations.add()
+    violation.field = 'keys[0]'
+    violation.description = 'Incomplete key.'
+    status.details.add().Pack(bad_request)
+    retry_info = error_details_pb2.RetryInfo()
+    retry_info.retry_delay.seconds = 2
+    status.details.add().Pack(retry_info)
+    status.details.add().Pack(timestamp_pb2.Timestamp(seconds=1))
+    response = httplib2.Response({
+        'status': 400,
+        'content-type': 'application/x-protobuf',
+    })
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST',
+        body=payload,
+        headers=self.makeExpectedHeaders(payload)).AndReturn((
+            response,
+            status.SerializeToString()))
+    self.mox.ReplayAll()
+
+    with self.assertRaises(datastore.RPCError) as ctx:
+      self.conn.lookup(request)
+    e = ctx.exception
+    self.assertEqual(bad_request, e.get_detail(error_details_pb2.BadRequest))
+    self.assertIsNone(e.get_detail(error_details_pb2.QuotaFailure))
+    # Unknown detail types are left packed.
+    self.assertEqual(status.details[2], e.details[2])
+    self.assertEqual(2, e.retry_after)
+    self.mox.VerifyAll()
+
+  def testLookupFailureWithCorruptDetail(self):
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    status = datastore.Status()
+    status.code = code_pb2.ABORTED
+    status.message = 'Too much contention.'
+    corrupt = status.details.add()
+    corrupt.type_url = 'type.googleapis.com/google.rpc.BadRequest'
+    corrupt.value = '\x0a\x05ab'  # Truncated field_violations entry.
+    response = httplib2.Response({
+        'status': 409,
+        'content-type': 'application/x-protobuf',
+    })
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST',
+        body=payload,
+        headers=self.makeExpectedHeaders(payload)).AndReturn((
+            response,
+            status.SerializeToString()))
+    self.mox.ReplayAll()
+
+    with self.assertRaises(datastore.RPCError) as ctx:
+      self.conn.lookup(request)
+    e = ctx.exception
+    self.assertEqual(code_pb2.ABORTED, e.code)
+    self.assertTrue(datastore.is_aborted(e))
+    # The malformed detail is left packed.
+    self.assertEqual([corrupt], e.details)
+    self.mox.VerifyAll()
+
   def testLookupFailureWithNonStatus(self):
     request = self.makeLookupRequest()
     payload = request.SerializeToString()
@@ -150,10 +308,69 @@ class DatastoreTest(unittest.TestCase):
     with self.assertRaisesRegexp(
         datastore.RPCError,
         'datastore call lookup failed: '
-        'Non-protobuf error: There was an error. HTTP status code was: 400'):
+        'Non-protobuf error: There was an error. HTTP status code was: 400'
+    ) as ctx:
+      self.conn.lookup(request)
+    self.assertEqual(code_pb2.INVALID_ARGUMENT, ctx.exception.code)
+    self.mox.VerifyAll()
+
+  def testLookupFailureResourceExhausted(self):
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    response = httplib2.Response({
+        'status': 429,
+        'retry-after': '30',
+    })
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST',
+        body=payload,
+        headers=self.makeExpectedHeaders(payload)).AndReturn((
+            response,
+            'Quota exceeded'))
+    self.mox.ReplayAll()
+
+    with self.assertRaises(datastore.RPCError) as ctx:
       self.conn.lookup(request)
+    self.assertEqual(code_pb2.RESOURCE_EXHAUSTED, ctx.exception.code)
+    self.assertEqual(30, ctx.exception.retry_after)
     self.mox.VerifyAll()
 
+  def testCodeFromHttpStatus(self):
+    self.assertEqual(code_pb2.INVALID_ARGUMENT,
+                     connection._code_from_http_status(400))
+    self.assertEqual(code_pb2.UNAUTHENTICATED,
+                     connection._code_from_http_status(401))
+    self.assertEqual(code_pb2.PERMISSION_DENIED,
+                     connection._code_from_http_status(403))
+    self.assertEqual(code_pb2.NOT_FOUND,
+                     connection._code_from_http_status(404))
+    self.assertEqual(code_pb2.ABORTED,
+                     connection._code_from_http_status(409))
+    self.assertEqual(code_pb2.RESOURCE_EXHAUSTED,
+                     connection._code_from_http_status(429))
+    self.assertEqual(code_pb2.UNAVAILABLE,
+                     connection._code_from_http_status(503))
+    self.assertEqual(code_pb2.DEADLINE_EXCEEDED,
+                     connection._code_from_http_status(504))
+    self.assertEqual(code_pb2.INTERNAL,
+                     connection._code_from_http_status(500))
+    self.assertEqual(code_pb2.INTERNAL,
+                     connection._code_from_http_status(502))
+    self.assertEqual(code_pb2.UNKNOWN,
+                     connection._code_from_http_status(418))
+
+  def testParseRetryAfter(self):
+    def parse(value):
+      return connection._parse_retry_after(
+          httplib2.Response({'status': 503, 'retry-after': value}))
+    self.assertEqual(1.5, parse('1.5'))
+    self.assertEqual(0, parse('Wed, 21 Oct 2015 07:28:00 GMT'))
+    self.assertIsNone(parse('soon'))
+    self.assertIsNone(connection._parse_retry_after(
+        httplib2.Response({'status': 503})))
+
   def testLookupFailureUnexpectedOk(self):
     request = self.makeLookupRequest()
     payload = request.SerializeToString()
@@ -228,6 +445,121 @@ class DatastoreTest(unittest.TestCase):
     self.assertEqual(proto_response, resp)
     self.mox.VerifyAll()
 
+  def testRunQueryAll(self):
+    request = datastore.RunQueryRequest()
+    request.query.kind.add().name = 'Foo'
+    request.query.offset = 3
+    request.query.limit.value = 5
+    first_response = datastore.RunQueryResponse()
+    first_response.batch.entity_results.add().entity.key.path.add().id = 1
+    first_response.batch.skipped_results = 3
+    first_response.batch.end_cursor = 'cursor1'
+    first_response.batch.more_results = (
+        datastore.QueryResultBatch.NOT_FINISHED)
+    second_request = datastore.RunQueryRequest()
+    second_request.CopyFrom(request)
+    second_request.query.start_cursor = 'cursor1'
+    second_request.query.offset = 0
+    second_request.query.limit.value = 4
+    second_response = datastore.RunQueryResponse()
+    second_response.batch.entity_results.add().entity.key.path.add().id = 2
+    second_response.batch.more_results = (
+        datastore.QueryResultBatch.MORE_RESULTS_AFTER_LIMIT)
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+
+    self.mox.StubOutWithMock(self.conn._http, 'request')
+    for req, resp in ((request, first_response),
+                      (second_request, second_response)):
+      payload = req.SerializeToString()
+      self.conn._http.request(
+          'https://example.com/datastore/v1/projects/foo:runQuery',
+          method='POST', body=payload,
+          headers=self.makeExpectedHeaders(payload)).AndReturn((
+              response,
+              resp.SerializeToString()))
+    self.mox.ReplayAll()
+
+    results = list(self.conn.run_query_all(request))
+    self.assertEqual([1, 2], [r.entity.key.path[0].id for r in results])
+    # The caller's request is left untouched.
+    self.assertEqual(3, request.query.offset)
+    self.assertEqual('', request.query.start_cursor)
+    self.mox.VerifyAll()
+
+  def testSlowCallLogging(self):
+    self.conn = datastore.Datastore(
+        project_endpoint='https://example.com/datastore/v1/projects/foo',
+        slow_call_threshold=1.0)
+    request = datastore.RunQueryRequest()
+    request.query.kind.add().name = 'Foo'
+    helper.set_property_filter(request.query.filter, 'bar',
+                               datastore.PropertyFilter.EQUAL, u'secret')
+    payload = request.SerializeToString()
+    proto_response = datastore.RunQueryResponse()
+    proto_response.batch.entity_results.add()
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:runQuery',
+        method='POST', body=payload,
+        headers=self.makeExpectedHeaders(payload)).AndReturn((
+            response,
+            proto_response.SerializeToString()))
+    self.mox.StubOutWithMock(connection.time, 'time')
+    connection.time.time().AndReturn(10.0)
+    connection.time.time().AndReturn(12.0)
+    self.mox.StubOutWithMock(connection.logging, 'warning')
+    connection.logging.warning(
+        mox.IgnoreArg(), 'runQuery', 2.0,
+        'kind=Foo filter=bar order=- batch_size=1')
+    self.mox.ReplayAll()
+
+    self.conn.run_query(request)
+    self.mox.VerifyAll()
+
+  def testSlowCallLoggingOnFailure(self):
+    self.conn = datastore.Datastore(
+        project_endpoint='https://example.com/datastore/v1/projects/foo',
+        slow_call_threshold=1.0)
+    request = datastore.RunQueryRequest()
+    request.query.kind.add().name = 'Foo'
+    payload = request.SerializeToString()
+    response = httplib2.Response({'status': 504})
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:runQuery',
+        method='POST', body=payload,
+        headers=self.makeExpectedHeaders(payload)).AndReturn((
+            response,
+            'Deadline exceeded'))
+    self.mox.StubOutWithMock(connection.time, 'time')
+    connection.time.time().AndReturn(10.0)
+    connection.time.time().AndReturn(70.0)
+    self.mox.StubOutWithMock(connection.logging, 'warning')
+    connection.logging.warning(
+        mox.IgnoreArg(), 'runQuery', 60.0,
+        'kind=Foo filter=- order=- (failed)')
+    self.mox.ReplayAll()
+
+    self.assertRaises(datastore.RPCError, self.conn.run_query, request)
+    self.mox.VerifyAll()
+
+  def testDescribeGqlCall(self):
+    request = datastore.RunQueryRequest()
+    request.gql_query.query_string = "SELECT * FROM Foo WHERE ssn = '123'"
+    request.gql_query.named_bindings['a'].value.integer_value = 1
+    request.gql_query.positional_bindings.add().value.integer_value = 2
+    response = datastore.RunQueryResponse()
+    response.batch.entity_results.add()
+    self.assertEqual('gql bindings=2 batch_size=1',
+                     connection._describe_call(request, response))
+
   def testBeginTransaction(self):
     request = datastore.BeginTransactionRequest()
     payload = request.SerializeToString()
@@ -271,6 +603,33 @@ class DatastoreTest(unittest.TestCase):
     self.assertEqual(proto_response, resp)
     self.mox.VerifyAll()
 
+  def testCommitEntityTooLarge(self):
+    request = datastore.CommitRequest()
+    entity = request.mutations.add().upsert
+    helper.add_key_path(entity.key, 'Foo', 1, 'Bar', 'bar')
+    helper.add_properties(
+        entity, {'blob': 'x' * connection.MAX_ENTITY_SIZE})
+    self.mox.StubOutWithMock(self.conn._http, 'request')
+    self.mox.ReplayAll()
+
+    with self.assertRaisesRegexp(
+        ValueError, r"entity Foo\(1\)/Bar\(u?'bar'\) is \d+ bytes"):
+      self.conn.commit(request)
+    self.mox.VerifyAll()
+
+  def testCommitRequestTooLarge(self):
+    request = datastore.CommitRequest()
+    for i in range(11):
+      entity = request.mutations.add().insert
+      helper.add_key_path(entity.key, 'Foo', i + 1)
+      helper.add_properties(entity, {'blob': 'x' * (1024 * 1024 - 64)})
+    self.mox.StubOutWithMock(self.conn._http, 'request')
+    self.mox.ReplayAll()
+
+    with self.assertRaisesRegexp(ValueError, 'commit request is \\d+ bytes'):
+      self.conn.commit(request)
+    self.mox.VerifyAll()
+
   def testRollback(self):
     request = datastore.RollbackRequest()
     request.transaction = 'transaction-id'
@@ -336,6 +695,90 @@ class DatastoreTest(unittest.TestCase):
     self.assertEqual(proto_response, resp)
     self.mox.VerifyAll()
 
+  def testUserAgent(self):
+    self.conn = datastore.Datastore(
+        project_endpoint='https://example.com/datastore/v1/projects/foo',
+        user_agent='my-app/1.2')
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    proto_response = self.makeLookupResponse()
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+    expected_headers = self.makeExpectedHeaders(payload)
+    expected_headers['User-Agent'] = (
+        'googledatastore-python/%s my-app/1.2' % datastore.__version__)
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST', body=payload,
+        headers=expected_headers).AndReturn((
+            response,
+            proto_response.SerializeToString()))
+    self.mox.ReplayAll()
+
+    resp = self.conn.lookup(request)
+    self.assertEqual(proto_response, resp)
+    self.mox.VerifyAll()
+
+  def testHeaderOverridesConnectionHeader(self):
+    self.conn = datastore.Datastore(
+        project_endpoint='https://example.com/datastore/v1/projects/foo',
+        quota_project_id='billed')
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    proto_response = self.makeLookupResponse()
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+    expected_headers = self.makeExpectedHeaders(payload)
+    del expected_headers['User-Agent']
+    expected_headers['user-agent'] = 'custom/1.0'
+    expected_headers['X-Goog-User-Project'] = 'other'
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST', body=payload,
+        headers=expected_headers).AndReturn((
+            response,
+            proto_response.SerializeToString()))
+    self.mox.ReplayAll()
+
+    resp = self.conn.lookup(request, headers={
+        'user-agent': 'custom/1.0',
+        'X-Goog-User-Project': 'other',
+    })
+    self.assertEqual(proto_response, resp)
+    self.mox.VerifyAll()
+
+  def testQuotaProject(self):
+    self.conn = datastore.Datastore(
+        project_endpoint='https://example.com/datastore/v1/projects/foo',
+        quota_project_id='billed')
+    request = self.makeLookupRequest()
+    payload = request.SerializeToString()
+    proto_response = self.makeLookupResponse()
+    response = httplib2.Response({
+        'status': 200,
+        'content-type': 'application/x-protobuf',
+    })
+    expected_headers = self.makeExpectedHeaders(payload)
+    expected_headers['x-goog-user-project'] = 'billed'
+
+    self.expectRequest(
+        'https://example.com/datastore/v1/projects/foo:lookup',
+        method='POST', body=payload,
+        headers=expected_headers).AndReturn((
+            response,
+            proto_response.SerializeToString()))
+    self.mox.ReplayAll()
+
+    resp = self.conn.lookup(request)
+    self.assertEqual(proto_response, resp)
+    self.mox.VerifyAll()
+
   def testSetOptions(self):
     other_thread_conn = []
     lock1 = threading.Lock()
@@ -445,5 +888,43 @@ class DatastoreTest(unittest.TestCase):
     except connection.RPCError:
       pass
 
+  def testErrorPredicates(self):
+    aborted = connection.RPCError('commit', code_pb2.ABORTED, 'message')
+    not_found = connection.RPCError('commit', code_pb2.NOT_FOUND, 'message')
+    unavailable = connection.RPCError('lookup', code_pb2.UNAVAILABLE,
+                                      'message')
+    self.assertTrue(datastore.is_retryable(aborted))
+    self.assertTrue(datastore.is_retryable(unavailable))
+    self.assertFalse(datastore.is_retryable(not_found))
+    self.assertFalse(datastore.is_retryable(ValueError()))
+    self.assertTrue(datastore.is_aborted(aborted))
+    self.assertFalse(datastore.is_aborted(unavailable))
+    self.assertTrue(datastore.is_not_found(not_found))
+    self.assertFalse(datastore.is_not_found(aborted))
+    already_exists = connection.RPCError('commit', code_pb2.ALREADY_EXISTS,
+                                         'message')
+    self.assertTrue(datastore.is_already_exists(already_exists))
+    self.assertFalse(datastore.is_already_exists(not_found))
+    self.assertFalse(datastore.is_already_exists(ValueError()))
+    self.assertFalse(datastore.is_retryable(already_exists))
+
+  def testErrorPredicatesForNonProtobufErrors(self):
+    def make_error(status, content='<html>error</html>'):
+      return connection._make_rpc_error(
+          'lookup', httplib2.Response({'status': status}), content)
+    for status in (400, 401, 403, 404):
+      self.assertFalse(datastore.is_retryable(make_error(status)), status)
+    self.assertTrue(datastore.is_not_found(make_error(404)))
+    self.assertTrue(datastore.is_aborted(make_error(409)))
+    for status in (409, 429, 500, 503, 504):
+      self.assertTrue(datastore.is_retryable(make_error(status)), status)
+    # A protobuf content type with an unparsable body still uses the status.
+    unparsable = connection._make_rpc_error(
+        'lookup',
+        httplib2.Response({'status': 403,
+                           'content-type': 'application/x-protobuf'}),
+        'cannot parse this as a Status')
+    self.assertFalse(datastore.is_retryable(unparsable))
+
 if __name__ == '__main__':
   unittest.main()
@@ -18,6 +18,7 @@
 __author__ = 'eddavisson@google.com (Ed Davisson)'
 
 
+from distutils import spawn
 import httplib
 import logging
 import os
@@ -34,6 +35,8 @@ import portpicker
 
 
 _DEFAULT_EMULATOR_OPTIONS = ['--testing']
+# gcloud equivalent of _DEFAULT_EMULATOR_OPTIONS.
+_DEFAULT_GCLOUD_EMULATOR_OPTIONS = ['--consistency=1.0', '--no-store-on-disk']
 
 
 class DatastoreEmulatorFactory(object):
@@ -133,12 +136,8 @@ class DatastoreEmulator(object):
     Raises:
       IOError: if the emulator failed to start within the deadline
     """
-    self._project_id = project_id
     self._emulator_cmd = emulator_cmd
-    self._http = httplib2.Http()
-    self.__running = False
-
-    self._tmp_dir = tempfile.mkdtemp(dir=working_directory)
+    self._Setup(project_id, working_directory)
     self._project_directory = os.path.join(self._tmp_dir, self._project_id)
     p = subprocess.Popen([emulator_cmd,
                           'create',
@@ -150,12 +149,38 @@ class DatastoreEmulator(object):
 
     # Start the emulator and wait for it to start responding to requests.
     port = portpicker.PickUnusedPort()
-    self._host = 'http://localhost:%d' % port
     cmd = [self._emulator_cmd, 'start', '--port=%d' % port]
     cmd.extend(_DEFAULT_EMULATOR_OPTIONS)
     if start_options:
       cmd.extend(start_options)
     cmd.append(self._project_directory)
+    self._Start(cmd, port, deadline)
+
+  def _Setup(self, project_id, working_directory):
+    """Initializes the state shared by all emulators before starting one.
+
+    Args:
+      project_id: project ID
+      working_directory: directory where temporary files will be stored
+    """
+    self._project_id = project_id
+    self._http = httplib2.Http()
+    self.__running = False
+    self._tmp_dir = tempfile.mkdtemp(dir=working_directory)
+
+  def _Start(self, cmd, port, deadline):
+    """Runs the emulator start command and waits for it to respond.
+
+    Args:
+      cmd: the command starting the emulator on port
+      port: the port the emulator listens on
+      deadline: number of seconds to wait for the datastore to start
+
+    Raises:
+      IOError: if the emulator failed to start within the deadline
+    """
+    self._port = port
+    self._host = 'http://localhost:%d' % port
     subprocess.Popen(cmd)
     if not self._WaitForStartup(deadline):
       raise IOError('emulator did not respond within %ds' % deadline)
@@ -167,6 +192,18 @@ class DatastoreEmulator(object):
     """Returns a googledatatsore.Datastore that is connected to the emulator."""
     return self.__datastore
 
+  def GetEnv(self):
+    """Returns the environment variables pointing clients at the emulator.
+
+    Usage:
+      >>> os.environ.update(emulator.GetEnv())
+      >>> googledatastore.get_default_connection()  # uses the emulator
+    """
+    return {
+        'DATASTORE_EMULATOR_HOST': 'localhost:%d' % self._port,
+        'DATASTORE_PROJECT_ID': self._project_id,
+    }
+
   def _WaitForStartup(self, deadline):
     """Waits for the emulator to start.
 
@@ -231,3 +268,39 @@ class DatastoreEmulator(object):
     logging.warning('emulator shutting down due to '
                     'DatastoreEmulator object deletion')
     self.Stop()
+
+
+class GcloudDatastoreEmulator(DatastoreEmulator):
+  """A Datastore emulator started with the gcloud command line tool."""
+
+  def __init__(self, project_id, gcloud=None, working_directory=None,
+               deadline=30, start_options=None):
+    """Constructs and starts a GcloudDatastoreEmulator.
+
+    Args:
+      project_id: project ID
+      gcloud: path to the gcloud executable, defaults to the one on the PATH
+      working_directory: directory where temporary files will be stored,
+          defaults to the system temporary directory
+      deadline: number of seconds to wait for the datastore to start
+      start_options: a list of additional command-line options to pass to
+          'gcloud beta emulators datastore start'
+
+    Raises:
+      IOError: if gcloud could not be found or the emulator failed to start
+          within the deadline
+    """
+    self._Setup(project_id, working_directory)
+    gcloud = gcloud or spawn.find_executable('gcloud')
+    if not gcloud:
+      shutil.rmtree(self._tmp_dir)
+      raise IOError('could not find gcloud on the PATH')
+    port = portpicker.PickUnusedPort()
+    cmd = [gcloud, 'beta', 'emulators', 'datastore', 'start',
+           '--project=%s' % self._project_id,
+           '--host-port=localhost:%d' % port,
+           '--data-dir=%s' % self._tmp_dir]
+    cmd.extend(_DEFAULT_GCLOUD_EMULATOR_OPTIONS)
+    if start_options:
+      cmd.extend(start_options)
+    self._Start(cmd, port, deadline)
@@ -0,0 +1,94 @@
+#
+# Copyright 2026 Google LLC. All Rights Reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+#
+"""googledatastore emulator wrapper test suite."""
+
+import unittest
+
+import httplib2
+import mox
+
+from googledatastore import datastore_emulator
+
+
+class GcloudDatastoreEmulatorTest(unittest.TestCase):
+
+  def setUp(self):
+    self.mox = mox.Mox()
+    self.mox.StubOutWithMock(datastore_emulator.httplib2, 'Http',
+                             use_mock_anything=True)
+    self.mox.StubOutWithMock(datastore_emulator.tempfile, 'mkdtemp')
+    self.mox.StubOutWithMock(datastore_emulator.shutil, 'rmtree')
+    self.http = self.mox.CreateMockAnything()
+    datastore_emulator.httplib2.Http().AndReturn(self.http)
+    datastore_emulator.tempfile.mkdtemp(dir=None).AndReturn('/tmp/emulator')
+
+  def tearDown(self):
+    self.mox.UnsetStubs()
+    self.mox.ResetAll()
+
+  def testStart(self):
+    self.mox.StubOutWithMock(datastore_emulator.portpicker, 'PickUnusedPort')
+    self.mox.StubOutWithMock(datastore_emulator.subprocess, 'Popen',
+                             use_mock_anything=True)
+    self.mox.StubOutWithMock(datastore_emulator.GcloudDatastoreEmulator,
+                             '_WaitForStartup', use_mock_anything=True)
+    datastore_emulator.portpicker.PickUnusedPort().AndReturn(12345)
+    datastore_emulator.subprocess.Popen([
+        '/sdk/bin/gcloud', 'beta', 'emulators', 'datastore', 'start',
+        '--project=foo',
+        '--host-port=localhost:12345',
+        '--data-dir=/tmp/emulator',
+        '--consistency=1.0',
+        '--no-store-on-disk',
+        '--verbosity=debug',
+    ])
+    datastore_emulator.GcloudDatastoreEmulator._WaitForStartup(5).AndReturn(
+        True)
+    # The connection returned by GetDatastore.
+    datastore_emulator.httplib2.Http().AndReturn(
+        self.mox.CreateMockAnything())
+    self.http.request(
+        'http://localhost:12345/shutdown', method='POST',
+        headers={'Content-length': '0'}).AndReturn(
+            (httplib2.Response({'status': 200}), ''))
+    datastore_emulator.shutil.rmtree('/tmp/emulator')
+    self.mox.ReplayAll()
+
+    emulator = datastore_emulator.GcloudDatastoreEmulator(
+        'foo', gcloud='/sdk/bin/gcloud', deadline=5,
+        start_options=['--verbosity=debug'])
+    self.assertEqual({
+        'DATASTORE_EMULATOR_HOST': 'localhost:12345',
+        'DATASTORE_PROJECT_ID': 'foo',
+    }, emulator.GetEnv())
+    self.assertEqual('http://localhost:12345/v1/projects/foo',
+                     emulator.GetDatastore()._url)
+    emulator.Stop()
+    self.mox.VerifyAll()
+
+  def testGcloudNotFound(self):
+    self.mox.StubOutWithMock(datastore_emulator.spawn, 'find_executable')
+    datastore_emulator.spawn.find_executable('gcloud').AndReturn(None)
+    datastore_emulator.shutil.rmtree('/tmp/emulator')
+    self.mox.ReplayAll()
+
+    self.assertRaisesRegexp(IOError, 'could not find gcloud',
+                            datastore_emulator.GcloudDatastoreEmulator, 'foo')
+    self.mox.VerifyAll()
+
+
+if __name__ == '__main__':
+  unittest.main()
@@ -17,8 +17,10 @@
 
 import calendar
 import datetime
+import json
 import logging
 import os
+import socket
 
 import httplib2
 from oauth2client import client
@@ -27,8 +29,10 @@ from google.cloud.proto.datastore.v1 import query_pb2
 
 __all__ = [
     'get_credentials_from_env',
+    'get_project_id_from_env',
     'get_project_endpoint_from_env',
     'add_key_path',
+    'compare_keys',
     'add_properties',
     'set_property',
     'set_value',
@@ -39,6 +43,8 @@ __all__ = [
     'add_projection',
     'set_property_filter',
     'set_composite_filter',
+    'set_key_range_filter',
+    'get_key_split_points',
     'to_timestamp',
     'from_timestamp',
 ]
@@ -64,6 +70,11 @@ _DATASTORE_PRIVATE_KEY_FILE_ENV = 'DATASTORE_PRIVATE_KEY_FILE'
 _DATASTORE_URL_OVERRIDE_ENV = '__DATASTORE_URL_OVERRIDE'
 _DATASTORE_USE_STUB_CREDENTIAL_FOR_TEST_ENV = (
     '__DATASTORE_USE_STUB_CREDENTIAL_FOR_TEST')
+_GOOGLE_CLOUD_PROJECT_ENV = 'GOOGLE_CLOUD_PROJECT'
+_GOOGLE_APPLICATION_CREDENTIALS_ENV = 'GOOGLE_APPLICATION_CREDENTIALS'
+_METADATA_PROJECT_ID_URL = (
+    'http://metadata.google.internal/computeMetadata/v1/project/project-id')
+_METADATA_TIMEOUT_SECS = 3
 # Deprecated
 _DATASTORE_HOST_ENV = 'DATASTORE_HOST'
 
@@ -111,12 +122,60 @@ def get_credentials_from_env():
     raise e
 
 
+def get_project_id_from_env():
+  """Get the Cloud project id from the environment.
+
+  Preference of project id is:
+  - DATASTORE_PROJECT_ID environment variable
+  - GOOGLE_CLOUD_PROJECT environment variable
+  - project_id of the credentials file named by the
+  GOOGLE_APPLICATION_CREDENTIALS environment variable
+  - the Compute Engine metadata server, unless DATASTORE_EMULATOR_HOST is set
+
+  Returns:
+    the project id or None.
+  """
+  project_id = (os.getenv(_DATASTORE_PROJECT_ID_ENV)
+                or os.getenv(_GOOGLE_CLOUD_PROJECT_ENV))
+  if project_id:
+    return project_id
+  credentials_file = os.getenv(_GOOGLE_APPLICATION_CREDENTIALS_ENV)
+  if credentials_file:
+    try:
+      with open(credentials_file, 'rb') as f:
+        credentials_info = json.load(f)
+    except (IOError, ValueError), e:
+      logging.warning('Unable to read project_id from %s: %s',
+                      credentials_file, e)
+    else:
+      if isinstance(credentials_info, dict):
+        project_id = credentials_info.get('project_id')
+    if project_id:
+      return project_id
+  if os.getenv(_DATASTORE_EMULATOR_HOST_ENV):
+    # Do not wait on the network for a local setup.
+    return None
+  return _get_project_id_from_metadata_server()
+
+
+def _get_project_id_from_metadata_server():
+  """Get the project id from the Compute Engine metadata server, or None."""
+  try:
+    response, content = httplib2.Http(timeout=_METADATA_TIMEOUT_SECS).request(
+        _METADATA_PROJECT_ID_URL, headers={'Metadata-Flavor': 'Google'})
+  except (httplib2.HttpLib2Error, socket.error), e:
+    logging.debug('metadata server is not available: %s', e)
+    return None
+  if response.status != 200:
+    return None
+  return content.strip() or None
+
+
 def get_project_endpoint_from_env(project_id=None, host=None):
   """Get Datastore project endpoint from environment variables.
 
   Args:
-    project_id: The Cloud project, defaults to the environment
-        variable DATASTORE_PROJECT_ID.
+    project_id: The Cloud project, defaults to get_project_id_from_env().
     host: The Cloud Datastore API host to use.
 
   Returns:
@@ -127,10 +186,13 @@ def get_project_endpoint_from_env(project_id=None, host=None):
     ValueError: if the wrong environment variable was set or a project_id was
         not provided.
   """
-  project_id = project_id or os.getenv(_DATASTORE_PROJECT_ID_ENV)
+  project_id = project_id or get_project_id_from_env()
   if not project_id:
     raise ValueError('project_id was not provided. Either pass it in '
-                     'directly or set DATASTORE_PROJECT_ID.')
+                     'directly, set DATASTORE_PROJECT_ID or '
+                     'GOOGLE_CLOUD_PROJECT, point '
+                     'GOOGLE_APPLICATION_CREDENTIALS at a credentials file '
+                     'with a project_id, or run on Compute Engine.')
   # DATASTORE_HOST is deprecated.
   if os.getenv(_DATASTORE_HOST_ENV):
     logging.warning('Ignoring value of environment variable DATASTORE_HOST. '
@@ -194,6 +256,55 @@ def add_key_path(key_proto, *path_elements):
   return key_proto
 
 
+def compare_keys(key1, key2):
+  """Compare two datastore.Key proto messages.
+
+  The ordering matches the one used by Cloud Datastore: keys are compared by
+  partition (project then namespace), then path element by path element, where
+  elements are compared by kind, then by id or name with ids sorting before
+  names. An ancestor sorts before its descendants.
+
+  Args:
+    key1: datastore.Key proto message.
+    key2: datastore.Key proto message.
+
+  Returns:
+    a negative number if key1 < key2, 0 if they are equal, and a positive
+    number otherwise.
+
+  Usage:
+    >>> sorted(keys, cmp=compare_keys)
+  """
+  result = (cmp(key1.partition_id.project_id, key2.partition_id.project_id)
+            or cmp(key1.partition_id.namespace_id,
+                   key2.partition_id.namespace_id))
+  if result:
+    return result
+  for elem1, elem2 in zip(key1.path, key2.path):
+    result = (cmp(_utf8(elem1.kind), _utf8(elem2.kind))
+              or cmp(_path_element_order(elem1), _path_element_order(elem2)))
+    if result:
+      return result
+  return cmp(len(key1.path), len(key2.path))
+
+
+def _path_element_order(elem):
+  """Returns a sort key for the id or name of a datastore.PathElement."""
+  id_type = elem.WhichOneof('id_type')
+  if id_type == 'id':
+    return (1, elem.id)
+  if id_type == 'name':
+    return (2, _utf8(elem.name))
+  return (0, None)  # incomplete
+
+
+def _utf8(s):
+  """Returns s as UTF-8 bytes, which is how Datastore compares strings."""
+  if isinstance(s, unicode):
+    return s.encode('utf-8')
+  return s
+
+
 def add_properties(entity_proto, property_dict, exclude_from_indexes=None):
   """Add values to the given datastore.Entity proto message.
 
@@ -402,6 +513,66 @@ def set_composite_filter(filter_proto, op, *filters):
   return filter_proto
 
 
+def set_key_range_filter(filter_proto, start_key=None, end_key=None):
+  """Set a __key__ range constraint in the given datastore.Filter proto message.
+
+  Args:
+    filter_proto: datastore.Filter proto message
+    start_key: inclusive lower bound datastore.Key, or None for no lower bound.
+    end_key: exclusive upper bound datastore.Key, or None for no upper bound.
+
+  Returns:
+    the same datastore.Filter.
+
+  Raises:
+    ValueError: if neither start_key nor end_key is set.
+
+  Usage:
+    >>> set_key_range_filter(filter_proto, k1, k2)  # WHERE k1 <= __key__ < k2
+  """
+  filters = []
+  if start_key is not None:
+    filters.append(set_property_filter(
+        query_pb2.Filter(), '__key__',
+        query_pb2.PropertyFilter.GREATER_THAN_OR_EQUAL, start_key))
+  if end_key is not None:
+    filters.append(set_property_filter(
+        query_pb2.Filter(), '__key__',
+        query_pb2.PropertyFilter.LESS_THAN, end_key))
+  if not filters:
+    raise ValueError('at least one of start_key and end_key is required.')
+  if len(filters) == 1:
+    filter_proto.CopyFrom(filters[0])
+    return filter_proto
+  return set_composite_filter(filter_proto, query_pb2.CompositeFilter.AND,
+                              *filters)
+
+
+def get_key_split_points(keys, num_shards):
+  """Pick keys splitting a kind into shards of roughly equal size.
+
+  Args:
+    keys: a sample of datastore.Key, for example the keys returned by a
+        keys-only query ordered by the __scatter__ property.
+    num_shards: the number of shards wanted.
+
+  Returns:
+    a sorted list of at most num_shards - 1 distinct datastore.Key. Shard i
+    covers the range between split point i - 1 and split point i, suitable
+    for set_key_range_filter.
+  """
+  keys = sorted(keys, cmp=compare_keys)
+  if num_shards < 2 or not keys:
+    return []
+  stride = float(len(keys)) / num_shards
+  split_points = []
+  for i in range(1, num_shards):
+    key = keys[int(i * stride)]
+    if not split_points or compare_keys(split_points[-1], key) < 0:
+      split_points.append(key)
+  return split_points
+
+
 _EPOCH = datetime.datetime.utcfromtimestamp(0)
 _MICROS_PER_SECOND = 1000000L
 _NANOS_PER_MICRO = 1000L
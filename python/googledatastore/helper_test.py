@@ -21,12 +21,16 @@ import collections
 import copy
 import datetime
 import os
+import socket
+import tempfile
 import unittest
 
+import httplib2
 import mox
 import pytz
 
 import googledatastore as datastore
+from googledatastore import helper
 from googledatastore.helper import *
 from google.protobuf.timestamp_pb2 import Timestamp
 
@@ -61,6 +65,34 @@ class DatastoreHelperTest(unittest.TestCase):
     key = datastore.Key()
     self.assertRaises(TypeError, add_key_path, key, 'Foo', 1.0)
 
+  def testCompareKeys(self):
+    def make_key(*path, **partition):
+      key = datastore.Key()
+      key.partition_id.project_id = partition.get('project', '')
+      key.partition_id.namespace_id = partition.get('namespace', '')
+      add_key_path(key, *path)
+      return key
+    ordered = [
+        make_key('Bar'),  # incomplete
+        make_key('Bar', 2),
+        make_key('Bar', 10),
+        make_key('Bar', 'a'),
+        make_key('Bar', 'a', 'Foo', 1),
+        make_key('Bar', 'b'),
+        make_key('Foo', 1),
+        make_key('Bar', 1, namespace='ns'),
+        make_key('Bar', 1, project='p'),
+    ]
+    shuffled = list(reversed(ordered))
+    self.assertEquals(ordered, sorted(shuffled, cmp=compare_keys))
+    self.assertEquals(0, compare_keys(make_key('Foo', 1), make_key('Foo', 1)))
+    # UTF-8 byte order puts U+1F600 after U+FF21. A narrow build compares
+    # its leading surrogate (U+D83D) and would put it first.
+    self.assertTrue(compare_keys(make_key('Foo', u'\U0001F600'),
+                                 make_key('Foo', u'\uFF21')) > 0)
+    self.assertTrue(compare_keys(make_key(u'\U0001F600', 1),
+                                 make_key(u'\uFF21', 1)) > 0)
+
   def testPropertyValues(self):
     property_dict = collections.OrderedDict(
         a_string=u'a',
@@ -172,6 +204,39 @@ class DatastoreHelperTest(unittest.TestCase):
     self.assertEquals(datastore.PropertyFilter.GREATER_THAN, pf.op)
     self.assertEquals(datastore.CompositeFilter.AND, cf.op)
 
+  def testKeyRangeFilter(self):
+    start = datastore.Key()
+    add_key_path(start, 'Foo', 1)
+    end = datastore.Key()
+    add_key_path(end, 'Foo', 10)
+    f = set_key_range_filter(datastore.Filter(), start, end)
+    cf = f.composite_filter
+    self.assertEquals(datastore.CompositeFilter.AND, cf.op)
+    pf = cf.filters[0].property_filter
+    self.assertEquals('__key__', pf.property.name)
+    self.assertEquals(datastore.PropertyFilter.GREATER_THAN_OR_EQUAL, pf.op)
+    self.assertEquals(start, pf.value.key_value)
+    pf = cf.filters[1].property_filter
+    self.assertEquals(datastore.PropertyFilter.LESS_THAN, pf.op)
+    self.assertEquals(end, pf.value.key_value)
+
+    pf = set_key_range_filter(datastore.Filter(), end_key=end).property_filter
+    self.assertEquals(datastore.PropertyFilter.LESS_THAN, pf.op)
+    self.assertRaises(ValueError, set_key_range_filter, datastore.Filter())
+
+  def testKeySplitPoints(self):
+    keys = []
+    for i in reversed(range(1, 11)):
+      key = datastore.Key()
+      add_key_path(key, 'Foo', i)
+      keys.append(key)
+    split_points = get_key_split_points(keys, 4)
+    self.assertEquals([3, 6, 8], [k.path[0].id for k in split_points])
+    self.assertEquals([], get_key_split_points(keys, 1))
+    self.assertEquals([], get_key_split_points([], 4))
+    # Split points are distinct even with more shards than keys.
+    self.assertEquals(2, len(get_key_split_points(keys[:2], 8)))
+
   def testDatetimeTimezone(self):
     dt_secs = 10000000L
     dt = datetime.datetime.fromtimestamp(dt_secs,
@@ -250,10 +315,111 @@ class DatastoreHelperTest(unittest.TestCase):
     self.mox.VerifyAll()
 
   def testEndpointWithNoProjectId(self):
+    self.mox.StubOutWithMock(os, 'getenv')
+    self.mox.StubOutWithMock(helper, '_get_project_id_from_metadata_server')
+    os.getenv('DATASTORE_PROJECT_ID').AndReturn(None)
+    os.getenv('GOOGLE_CLOUD_PROJECT').AndReturn(None)
+    os.getenv('GOOGLE_APPLICATION_CREDENTIALS').AndReturn(None)
+    os.getenv('DATASTORE_EMULATOR_HOST').AndReturn(None)
+    helper._get_project_id_from_metadata_server().AndReturn(None)
+    self.mox.ReplayAll()
     self.assertRaisesRegexp(
         ValueError,
         'project_id was not provided.*',
         get_project_endpoint_from_env)
+    self.mox.VerifyAll()
+
+  def testProjectIdFromGoogleCloudProject(self):
+    self.mox.StubOutWithMock(os, 'getenv')
+    os.getenv('DATASTORE_PROJECT_ID').AndReturn(None)
+    os.getenv('GOOGLE_CLOUD_PROJECT').AndReturn('bar')
+    self.mox.ReplayAll()
+    self.assertEqual('bar', get_project_id_from_env())
+    self.mox.VerifyAll()
+
+  def testProjectIdFromCredentialsFile(self):
+    with tempfile.NamedTemporaryFile(suffix='.json') as f:
+      f.write('{"type": "service_account", "project_id": "bar"}')
+      f.flush()
+      self.mox.StubOutWithMock(os, 'getenv')
+      os.getenv('DATASTORE_PROJECT_ID').AndReturn(None)
+      os.getenv('GOOGLE_CLOUD_PROJECT').AndReturn(None)
+      os.getenv('GOOGLE_APPLICATION_CREDENTIALS').AndReturn(f.name)
+      self.mox.ReplayAll()
+      self.assertEqual('bar', get_project_id_from_env())
+      self.mox.VerifyAll()
+
+  def testProjectIdFromCredentialsFileNotAnObject(self):
+    with tempfile.NamedTemporaryFile(suffix='.json') as f:
+      f.write('["project_id", "bar"]')
+      f.flush()
+      self.mox.StubOutWithMock(os, 'getenv')
+      os.getenv('DATASTORE_PROJECT_ID').AndReturn(None)
+      os.getenv('GOOGLE_CLOUD_PROJECT').AndReturn(None)
+      os.getenv('GOOGLE_APPLICATION_CREDENTIALS').AndReturn(f.name)
+      os.getenv('DATASTORE_EMULATOR_HOST').AndReturn('localhost:1234')
+      self.mox.ReplayAll()
+      self.assertIsNone(get_project_id_from_env())
+      self.mox.VerifyAll()
+
+  def testProjectIdSkipsMetadataServerWithEmulator(self):
+    self.mox.StubOutWithMock(os, 'getenv')
+    self.mox.StubOutWithMock(helper, '_get_project_id_from_metadata_server')
+    os.getenv('DATASTORE_PROJECT_ID').AndReturn(None)
+    os.getenv('GOOGLE_CLOUD_PROJECT').AndReturn(None)
+    os.getenv('GOOGLE_APPLICATION_CREDENTIALS').AndReturn(None)
+    os.getenv('DATASTORE_EMULATOR_HOST').AndReturn('localhost:1234')
+    self.mox.ReplayAll()
+    self.assertIsNone(get_project_id_from_env())
+    self.mox.VerifyAll()
+
+  def testProjectIdFromMetadataServer(self):
+    self.mox.StubOutWithMock(os, 'getenv')
+    self.mox.StubOutWithMock(helper, '_get_project_id_from_metadata_server')
+    os.getenv('DATASTORE_PROJECT_ID').AndReturn(None)
+    os.getenv('GOOGLE_CLOUD_PROJECT').AndReturn(None)
+    os.getenv('GOOGLE_APPLICATION_CREDENTIALS').AndReturn(None)
+    os.getenv('DATASTORE_EMULATOR_HOST').AndReturn(None)
+    helper._get_project_id_from_metadata_server().AndReturn('bar')
+    self.mox.ReplayAll()
+    self.assertEqual('bar', get_project_id_from_env())
+    self.mox.VerifyAll()
+
+  def expectMetadataRequest(self):
+    self.mox.StubOutWithMock(helper.httplib2, 'Http', use_mock_anything=True)
+    http = self.mox.CreateMockAnything()
+    helper.httplib2.Http(timeout=3).AndReturn(http)
+    return http.request(
+        'http://metadata.google.internal/computeMetadata/v1/project/'
+        'project-id',
+        headers={'Metadata-Flavor': 'Google'})
+
+  def testMetadataServerProjectId(self):
+    self.expectMetadataRequest().AndReturn(
+        (httplib2.Response({'status': 200}), 'bar\n'))
+    self.mox.ReplayAll()
+    self.assertEqual('bar', helper._get_project_id_from_metadata_server())
+    self.mox.VerifyAll()
+
+  def testMetadataServerNotFound(self):
+    self.expectMetadataRequest().AndReturn(
+        (httplib2.Response({'status': 404}), 'Not Found'))
+    self.mox.ReplayAll()
+    self.assertIsNone(helper._get_project_id_from_metadata_server())
+    self.mox.VerifyAll()
+
+  def testMetadataServerUnreachable(self):
+    self.expectMetadataRequest().AndRaise(socket.error('unreachable'))
+    self.mox.ReplayAll()
+    self.assertIsNone(helper._get_project_id_from_metadata_server())
+    self.mox.VerifyAll()
+
+  def testMetadataServerHttpError(self):
+    self.expectMetadataRequest().AndRaise(
+        httplib2.ServerNotFoundError('metadata.google.internal'))
+    self.mox.ReplayAll()
+    self.assertIsNone(helper._get_project_id_from_metadata_server())
+    self.mox.VerifyAll()
 
   def testEndpointWithUrlOverride(self):
     self.mox.StubOutWithMock(os, 'getenv')
@@ -13,9 +13,14 @@
 # See the License for the specific language governing permissions and
 # limitations under the License.
 #
+import re
+
 from setuptools import setup
 
-__version__ = '7.0.2'
+# Read the version without importing googledatastore, whose dependencies may
+# not be installed yet.
+with open('googledatastore/__init__.py') as f:
+  __version__ = re.search(r"^__version__ = '(.*)'$", f.read(), re.M).group(1)
 
 setup(
     name='googledatastore',